@@ -0,0 +1,38 @@
+// Written in 2015 by Jack Galilee. Convenient rights reserved.
+// Use of this source code is governed by the MIT-style
+// license that can be found in the LICENSE file.
+
+// Package asm compiles a small register-machine assembly language into
+// Conway's FRACTRAN, the language implemented by the parent fractran
+// package. It lets callers write FRACTRAN programs as INC/DEC/JZ/JMP/HALT
+// instructions over named registers instead of hand-crafting Gödel-numbered
+// fractions. The compiler itself lives in internal/regasm, shared with the
+// lang/asm package.
+package asm
+
+import (
+	"io"
+	"math/big"
+
+	"github.com/jgalilee/fractran/internal/regasm"
+)
+
+// Assembly is the result of compiling a register-machine source file. See
+// regasm.Assembly for field documentation.
+type Assembly = regasm.Assembly
+
+// CompileProgram lowers src into an Assembly, exposing the register prime
+// assignment alongside the FRACTRAN program so a caller can seed or decode
+// register values. See Compile for the thinner, position-agnostic form.
+func CompileProgram(src io.Reader) (*Assembly, error) {
+	return regasm.CompileProgram(src)
+}
+
+// Compile lowers src — a tiny register-machine assembly of INC r, DEC r, JZ
+// r label, JMP label and HALT instructions over labeled blocks — into an
+// equivalent FRACTRAN program and its initial value, ready to be run with
+// fractran.NewProgram(instrs). See CompileProgram for the full prime
+// assignment table.
+func Compile(src io.Reader) ([]*big.Rat, int64, error) {
+	return regasm.Compile(src)
+}
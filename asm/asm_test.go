@@ -0,0 +1,298 @@
+// Written in 2015 by Jack Galilee. Convenient rights reserved.
+// Use of this source code is governed by the MIT-style
+// license that can be found in the LICENSE file.
+package asm_test
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/jgalilee/fractran"
+	"github.com/jgalilee/fractran/asm"
+)
+
+func TestCompileInvalidPrograms(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{"empty program", ""},
+		{"unknown instruction", "FOO r1"},
+		{"inc missing register", "INC"},
+		{"jz missing label", "JZ r1"},
+		{"jmp undefined label", "JMP nowhere"},
+		{"duplicate label", "a:\nHALT\na:\nHALT"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := asm.CompileProgram(strings.NewReader(tt.src)); err == nil {
+				t.Errorf("expected error for source %q", tt.src)
+			}
+		})
+	}
+}
+
+// ExampleCompile_addition computes 3+4 using the classic register-machine
+// idiom for addition: drain r2 into r1 one unit at a time.
+func ExampleCompile_addition() {
+	const src = `
+INC r1
+INC r1
+INC r1
+INC r2
+INC r2
+INC r2
+INC r2
+loop:
+JZ r2 done
+DEC r2
+INC r1
+JMP loop
+done:
+HALT
+`
+	a, err := asm.CompileProgram(strings.NewReader(src))
+	if err != nil {
+		panic(err)
+	}
+	prog, err := fractran.NewBoundProgram(a.Fractions, 1000)
+	if err != nil {
+		panic(err)
+	}
+	var buf bytes.Buffer
+	if err := prog.Run(&buf, a.InitialN); err != nil {
+		panic(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	n, _ := new(big.Int).SetString(lines[len(lines)-1], 10)
+	fmt.Println(a.RegisterValue(n, "r1"), a.RegisterValue(n, "r2"))
+	// Output:
+	// 7 0
+}
+
+// ExampleCompile_multiplication computes 3*4 by repeatedly adding r2 into
+// r3, using raux as scratch space to copy r2 back after each pass so it can
+// be consumed again.
+func ExampleCompile_multiplication() {
+	const src = `
+INC r1
+INC r1
+INC r1
+INC r2
+INC r2
+INC r2
+INC r2
+outer:
+JZ r1 done
+DEC r1
+inner:
+JZ r2 restore
+DEC r2
+INC r3
+INC raux
+JMP inner
+restore:
+JZ raux outer
+DEC raux
+INC r2
+JMP restore
+done:
+HALT
+`
+	a, err := asm.CompileProgram(strings.NewReader(src))
+	if err != nil {
+		panic(err)
+	}
+	prog, err := fractran.NewBoundProgram(a.Fractions, 100000)
+	if err != nil {
+		panic(err)
+	}
+	var buf bytes.Buffer
+	if err := prog.Run(&buf, a.InitialN); err != nil {
+		panic(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	n, _ := new(big.Int).SetString(lines[len(lines)-1], 10)
+	fmt.Println(a.RegisterValue(n, "r3"))
+	// Output:
+	// 12
+}
+
+// ExampleCompile_parity tests whether r1 is even or odd, the test at the
+// heart of a Collatz step, by decrementing it two at a time into raux,
+// leaving the result in r2 (0 = even, 1 = odd) and restoring r1 from raux.
+// See ExampleCompile_collatzStep for the full step built on this test,
+// branching into the halving and 3n+1 subroutines it feeds.
+func ExampleCompile_parity() {
+	const src = `
+INC r1
+INC r1
+INC r1
+INC r1
+INC r1
+loop:
+JZ r1 restore
+DEC r1
+INC raux
+JZ r1 odd
+DEC r1
+INC raux
+JMP loop
+odd:
+INC r2
+restore:
+JZ raux done
+DEC raux
+INC r1
+JMP restore
+done:
+HALT
+`
+	a, err := asm.CompileProgram(strings.NewReader(src))
+	if err != nil {
+		panic(err)
+	}
+	prog, err := fractran.NewBoundProgram(a.Fractions, 10000)
+	if err != nil {
+		panic(err)
+	}
+	var buf bytes.Buffer
+	if err := prog.Run(&buf, a.InitialN); err != nil {
+		panic(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	n, _ := new(big.Int).SetString(lines[len(lines)-1], 10)
+	fmt.Println(a.RegisterValue(n, "r1"), a.RegisterValue(n, "r2"))
+	// Output:
+	// 5 1
+}
+
+// collatzStepBody is the Collatz-step assembly that follows the "INC r1" x n
+// header seeding the input: the parity test from ExampleCompile_parity
+// feeds a branch that either halves r1 (even) or sets it to 3*r1+1 (odd),
+// shared by ExampleCompile_collatzStep and TestCollatzStepBothBranches so
+// the two worked-example seeds don't drift apart.
+const collatzStepBody = `
+loop:
+JZ r1 restore
+DEC r1
+INC raux
+JZ r1 odd
+DEC r1
+INC raux
+INC rhalf
+JMP loop
+odd:
+INC r2
+restore:
+JZ raux branch
+DEC raux
+INC r1
+JMP restore
+branch:
+JZ r2 even
+threex:
+JZ r1 addone
+DEC r1
+INC rmul
+INC rmul
+INC rmul
+JMP threex
+addone:
+INC rmul
+JMP copyback
+even:
+JZ r1 copyhalf
+DEC r1
+JMP even
+copyhalf:
+JZ rhalf done
+DEC rhalf
+INC r1
+JMP copyhalf
+copyback:
+JZ rmul done
+DEC rmul
+INC r1
+JMP copyback
+done:
+HALT
+`
+
+// collatzStepSrc returns the Collatz-step program seeded with r1 = n.
+func collatzStepSrc(n int) string {
+	return strings.Repeat("INC r1\n", n) + collatzStepBody
+}
+
+// runCollatzStep compiles and runs src to completion, returning the final
+// values of r1 and r2.
+func runCollatzStep(t *testing.T, src string) (r1, r2 int64) {
+	t.Helper()
+	a, err := asm.CompileProgram(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("compile failed: %v", err)
+	}
+	prog, err := fractran.NewBoundProgram(a.Fractions, 100000)
+	if err != nil {
+		t.Fatalf("failed to build program: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := prog.Run(&buf, a.InitialN); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	n, _ := new(big.Int).SetString(lines[len(lines)-1], 10)
+	return a.RegisterValue(n, "r1"), a.RegisterValue(n, "r2")
+}
+
+// TestCollatzStepBothBranches exercises both branches the parity test in
+// collatzStepBody can take, so a regression in the halving path — untested
+// by ExampleCompile_collatzStep, which only ever seeds an odd r1 — would be
+// caught here instead of only in the 3n+1 path.
+func TestCollatzStepBothBranches(t *testing.T) {
+	tests := []struct {
+		name   string
+		n      int
+		wantR1 int64
+		wantR2 int64
+	}{
+		{"odd takes the 3n+1 branch", 5, 16, 1},
+		{"even takes the halving branch", 6, 3, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r1, r2 := runCollatzStep(t, collatzStepSrc(tt.n))
+			if r1 != tt.wantR1 || r2 != tt.wantR2 {
+				t.Errorf("n=%d: got r1=%d r2=%d, expected r1=%d r2=%d", tt.n, r1, r2, tt.wantR1, tt.wantR2)
+			}
+		})
+	}
+}
+
+// ExampleCompile_collatzStep computes one full Collatz step on r1 = 5: the
+// parity test from ExampleCompile_parity decides whether to take the
+// halving branch or the 3n+1 branch, leaving the result back in r1 (here,
+// 3*5+1 = 16, with r2 left at 1 to record that the odd branch fired). See
+// TestCollatzStepBothBranches for the complementary even/halving case.
+func ExampleCompile_collatzStep() {
+	a, err := asm.CompileProgram(strings.NewReader(collatzStepSrc(5)))
+	if err != nil {
+		panic(err)
+	}
+	prog, err := fractran.NewBoundProgram(a.Fractions, 100000)
+	if err != nil {
+		panic(err)
+	}
+	var buf bytes.Buffer
+	if err := prog.Run(&buf, a.InitialN); err != nil {
+		panic(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	n, _ := new(big.Int).SetString(lines[len(lines)-1], 10)
+	fmt.Println(a.RegisterValue(n, "r1"), a.RegisterValue(n, "r2"))
+	// Output:
+	// 16 1
+}
@@ -1,6 +1,10 @@
 // Written in 2015 by Jack Galilee. Convenient rights reserved.
 // Use of this source code is governed by the MIT-style
 // license that can be found in the LICENSE file.
+
+// Command fractran-lang is the original CLI, built on the lang package's
+// big.Rat-stepping Program. See cmd/fractran for the equivalent command
+// built on the root package's prime-exponent engine.
 package main
 
 import (
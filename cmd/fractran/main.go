@@ -43,13 +43,13 @@ func main() {
 		os.Exit(1)
 	}
 
-	instructions, err := new(fractran.Parser).Parse(src)
+	file, err := new(fractran.Parser).Parse(src)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "fractran: parse program: %v\n", err)
 		os.Exit(1)
 	}
 
-	program, err := fractran.NewProgram(instructions)
+	program, err := fractran.NewProgramFile(file)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "fractran: create program: %v\n", err)
 		os.Exit(1)
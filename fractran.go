@@ -2,14 +2,30 @@
 // Use of this source code is governed by the MIT-style
 // license that can be found in the LICENSE file.
 
-// Package lang implements Conway's FRACTRAN programming language.
+// Package fractran implements Conway's FRACTRAN programming language.
 // FRACTRAN is a Turing-complete esoteric programming language that consists
 // of a single positive integer and a finite list of positive fractions.
+//
+// This package's Parser builds a position-tracking AST (File, FractionLit,
+// ParseError) and its Program can run with a prime-exponent execution engine
+// (NewFactoredProgram) that avoids big.Rat normalization cost on the huge
+// integers long-running FRACTRAN programs produce, plus a channel-based
+// Stream API for consuming a run as it happens. Neither of those made it
+// into the sibling package github.com/jgalilee/fractran/lang, which instead
+// grew decimal/scientific literal support, ParseString/ParseFile,
+// context-cancellable execution (RunContext), a pluggable CycleDetector, and
+// gob-based checkpointing (MarshalBinary/Clone). The two packages model the
+// same language but were extended independently and haven't been
+// reconciled into one; pick fractran for AST-aware parsing, the factored
+// engine, or Stream, and lang for the cancellation/cycle-detection/
+// checkpointing feature set, or port the feature you need across — they're
+// similar enough that it's usually a small diff.
 package fractran
 
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -26,6 +42,8 @@ const (
 	comma symbol = iota
 	digit
 	slash
+	newline
+	space
 	done
 )
 
@@ -38,57 +56,149 @@ func (s symbol) String() string {
 		return "digit"
 	case slash:
 		return "slash"
+	case newline:
+		return "newline"
+	case space:
+		return "space"
 	case done:
 		return "done"
 	}
 	return "unknown"
 }
 
+// Pos is the location of a lexeme in FRACTRAN source: a 1-based line and
+// column, and a 0-based byte offset.
+type Pos struct {
+	Line, Col, Offset int
+}
+
+// String formats a position as "line:col".
+func (p Pos) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Col)
+}
+
+// FractionLit is a single p/q fraction literal together with the position of
+// its numerator in the source.
+type FractionLit struct {
+	Pos   Pos
+	Value *big.Rat
+}
+
+// File is the parsed syntax tree of a FRACTRAN program: its fraction
+// literals in source order.
+type File struct {
+	Fractions []*FractionLit
+}
+
+// Rats returns the fraction values of f, discarding source positions, for
+// callers that only need the instruction list.
+func (f *File) Rats() []*big.Rat {
+	rats := make([]*big.Rat, len(f.Fractions))
+	for i, frac := range f.Fractions {
+		rats[i] = frac.Value
+	}
+	return rats
+}
+
+// ParseError records the source position at which a parse error occurred.
+type ParseError struct {
+	Pos Pos
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Pos, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
 // Parser implements a recursive descent parser for FRACTRAN programs.
 type Parser struct {
 	currentSym  symbol
 	currentRune rune
 	lastRune    rune
 	r           *bufio.Reader
+
+	pos               Pos // position of currentRune
+	lastPos           Pos // position of lastRune
+	line, col, offset int
 }
 
-// next reads the next rune from the input source and tokenizes it.
-// If there was an error reading it panics. It assigns the current rune
-// as the last rune before reading.
+// next reads the next rune from the input source and tokenizes it, skipping
+// over `#` line comments. If there was an error reading it panics. It
+// assigns the current rune and position as the last rune and position
+// before reading.
 func (p *Parser) next() {
-	var err error
-	p.lastRune = p.currentRune
-	p.currentRune, _, err = p.r.ReadRune()
+	startPos := Pos{Line: p.line, Col: p.col, Offset: p.offset}
+	r, _, err := p.r.ReadRune()
 	if err == io.EOF {
+		p.lastRune, p.lastPos = p.currentRune, p.pos
 		p.currentSym = done
 		return
 	}
 	if err != nil {
 		panic(err)
 	}
-	// tokenize
+	p.offset++
+	if r == '\n' {
+		p.line++
+		p.col = 1
+	} else {
+		p.col++
+	}
+	p.lastRune, p.lastPos = p.currentRune, p.pos
+	p.currentRune, p.pos = r, startPos
 	switch {
-	case p.currentRune == ',':
+	case r == '#':
+		p.skipComment()
+		p.next()
+	case r == '\n':
+		p.currentSym = newline
+	case r == ' ' || r == '\t' || r == '\r':
+		p.currentSym = space
+	case r == ',':
 		p.currentSym = comma
-	case p.currentRune == '/':
+	case r == '/':
 		p.currentSym = slash
-	case unicode.IsDigit(p.currentRune):
+	case unicode.IsDigit(r):
 		p.currentSym = digit
 	default:
 		p.currentSym = done
 	}
 }
 
+// skipComment consumes runes up to, but not including, the newline that
+// ends a `#` line comment (or up to EOF).
+func (p *Parser) skipComment() {
+	for {
+		r, _, err := p.r.ReadRune()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			panic(err)
+		}
+		if r == '\n' {
+			p.r.UnreadRune()
+			return
+		}
+		p.offset++
+		p.col++
+	}
+}
+
 // current returns the current symbol.
 func (p *Parser) current() symbol {
 	return p.currentSym
 }
 
 // expect asserts that the current symbol is equal to the given symbol.
-// If it is not, an error is returned.
+// If it is not, a *ParseError positioned at the current symbol is returned.
 func (p *Parser) expect(sym symbol) error {
 	if sym != p.current() {
-		return fmt.Errorf("unexpected symbol %v, expected %v", p.current(), sym)
+		return p.errorf(p.pos, "unexpected symbol %v, expected %v", p.current(), sym)
 	}
 	return nil
 }
@@ -104,72 +214,122 @@ func (p *Parser) accept(sym symbol) bool {
 	return false
 }
 
-// integer reads the next integer from the input source.
-func (p *Parser) integer() (int64, error) {
-	var buff bytes.Buffer
+// errorf builds a *ParseError positioned at pos.
+func (p *Parser) errorf(pos Pos, format string, args ...interface{}) error {
+	return &ParseError{Pos: pos, Err: fmt.Errorf(format, args...)}
+}
+
+// skipSpace consumes zero or more consecutive space tokens.
+func (p *Parser) skipSpace() {
+	for p.accept(space) {
+	}
+}
+
+// skipTrivia consumes zero or more consecutive space and newline tokens,
+// allowing blank lines between or around fractions.
+func (p *Parser) skipTrivia() {
+	for p.accept(space) || p.accept(newline) {
+	}
+}
+
+// integer reads the next integer from the input source and returns its
+// value together with the position of its first digit.
+func (p *Parser) integer() (int64, Pos, error) {
 	if err := p.expect(digit); err != nil {
-		return -1, err
+		return -1, p.pos, err
 	}
+	pos := p.pos
+	var buff bytes.Buffer
 	for p.accept(digit) {
 		buff.WriteRune(p.lastRune)
 	}
-	return strconv.ParseInt(buff.String(), 10, 64)
+	v, err := strconv.ParseInt(buff.String(), 10, 64)
+	if err != nil {
+		return -1, pos, p.errorf(pos, "%v", err)
+	}
+	return v, pos, nil
 }
 
 // fraction reads the next fraction from the input source.
-func (p *Parser) fraction() (*big.Rat, error) {
-	var (
-		num int64
-		den int64
-		err error
-	)
-	if num, err = p.integer(); err != nil {
+func (p *Parser) fraction() (*FractionLit, error) {
+	p.skipSpace()
+	num, pos, err := p.integer()
+	if err != nil {
 		return nil, err
 	}
-	if err = p.expect(slash); err != nil {
+	p.skipSpace()
+	if err := p.expect(slash); err != nil {
 		return nil, err
 	}
 	p.next()
-	if den, err = p.integer(); err != nil {
+	p.skipSpace()
+	den, _, err := p.integer()
+	if err != nil {
 		return nil, err
 	}
-	return big.NewRat(num, den), nil
+	if den == 0 {
+		return nil, p.errorf(pos, "division by zero")
+	}
+	return &FractionLit{Pos: pos, Value: big.NewRat(num, den)}, nil
 }
 
-// program reads the program from the input source.
-func (p *Parser) program() ([]*big.Rat, error) {
-	var (
-		instr  *big.Rat
-		instrs []*big.Rat
-		err    error
-	)
+// program reads the program from the input source. Fractions may be
+// separated by commas, newlines, or both, and blank lines and `#` comments
+// are ignored, so that multi-line FRACTRAN listings with one annotated
+// fraction per line parse cleanly.
+func (p *Parser) program() (*File, error) {
 	p.next()
+	p.skipTrivia()
 	if p.current() == done {
-		return nil, fmt.Errorf("empty program")
+		return nil, p.errorf(p.pos, "empty program")
+	}
+	frac, err := p.fraction()
+	if err != nil {
+		return nil, err
 	}
-	for p.current() != done {
-		instr, err = p.fraction()
+	fracs := []*FractionLit{frac}
+	for {
+		p.skipSpace()
+		switch {
+		case p.accept(comma):
+			p.skipTrivia()
+		case p.accept(newline):
+			p.skipTrivia()
+			if p.current() == done {
+				return &File{Fractions: fracs}, nil
+			}
+		default:
+			if p.current() != done {
+				return nil, p.errorf(p.pos, "unexpected symbol %v, expected %v or %v", p.current(), comma, newline)
+			}
+			return &File{Fractions: fracs}, nil
+		}
+		frac, err = p.fraction()
 		if err != nil {
 			return nil, err
 		}
-		instrs = append(instrs, instr)
-		for p.accept(comma) {
-			instr, err = p.fraction()
-			if err != nil {
-				return nil, err
-			}
-			instrs = append(instrs, instr)
-		}
+		fracs = append(fracs, frac)
 	}
-	return instrs, nil
 }
 
-// Parse parses the input source and returns the program as a slice of fractions.
-func (p *Parser) Parse(src io.Reader) ([]*big.Rat, error) {
+// Parse parses the input source and returns its syntax tree.
+func (p *Parser) Parse(src io.Reader) (*File, error) {
 	p.r = bufio.NewReader(src)
+	p.line, p.col, p.offset = 1, 1, 0
 	return p.program()
 }
 
+// ParseFractions parses the input source and returns just the fraction
+// values, discarding source positions, for callers that predate the
+// AST-returning Parse.
+func (p *Parser) ParseFractions(src io.Reader) ([]*big.Rat, error) {
+	file, err := p.Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	return file.Rats(), nil
+}
+
 // Halt is returned when a FRACTRAN program terminates either because the maximum
 // bound is reached, or no fraction f in the instruction list L produces an integer
 // when multiplied by the current value n.
@@ -184,10 +344,95 @@ type Program struct {
 	Steps int64
 	// Bound is the maximum number of steps that can be taken (1,2,3,...,+Inf).
 	Bound float64
+	// MaxFactorPrime bounds the largest prime factor NewFactoredProgram will
+	// index directly. It is only meaningful on a Program built with
+	// NewFactoredProgram; see that function for details.
+	MaxFactorPrime int64
 
 	// Current value of n
 	n      *big.Rat
 	instrs []*big.Rat
+
+	// file is the AST the program was built from, if any (see
+	// NewProgramFile), used to annotate Debug output with source positions.
+	file *File
+
+	// factored, state and instrFactors back the prime-exponent execution
+	// engine used by NewFactoredProgram. When factored is false the program
+	// runs on the big.Rat engine above instead.
+	factored     bool
+	state        factors
+	instrFactors []factoredFraction
+}
+
+// factors maps a prime to its exponent in the factorization of some positive
+// integer. It doubles as the representation of the running state n in the
+// prime-exponent execution engine, where n == value().
+type factors map[int64]int64
+
+// DefaultMaxFactorPrime bounds the largest prime factor NewFactoredProgram
+// will index directly.
+const DefaultMaxFactorPrime = 1 << 20
+
+// factorize returns the prime factorization of x as a map of prime to
+// exponent. It returns ok == false if x has a prime factor larger than max,
+// in which case the caller should fall back to the big.Rat engine.
+func factorize(x *big.Int, max int64) (f factors, ok bool) {
+	f = make(factors)
+	rem := new(big.Int).Abs(x)
+	one := big.NewInt(1)
+	bd, q, r := new(big.Int), new(big.Int), new(big.Int)
+	for d := int64(2); d <= max && bd.SetInt64(d).Cmp(rem) <= 0; d++ {
+		for {
+			q.QuoRem(rem, bd, r)
+			if r.Sign() != 0 {
+				break
+			}
+			f[d]++
+			rem.Set(q)
+		}
+	}
+	return f, rem.Cmp(one) == 0
+}
+
+// value reconstructs the big.Int represented by a factorization as ∏ pᵉ.
+func (f factors) value() *big.Int {
+	v := big.NewInt(1)
+	for prime, exp := range f {
+		v.Mul(v, new(big.Int).Exp(big.NewInt(prime), big.NewInt(exp), nil))
+	}
+	return v
+}
+
+// divides reports whether every prime in den has at least as large an
+// exponent in f, i.e. whether the fraction with denominator den divides f.
+func (f factors) divides(den factors) bool {
+	for prime, exp := range den {
+		if f[prime] < exp {
+			return false
+		}
+	}
+	return true
+}
+
+// apply multiplies f in place by the fraction num/den, assumed to already
+// divide f.
+func (f factors) apply(num, den factors) {
+	for prime, exp := range den {
+		f[prime] -= exp
+		if f[prime] == 0 {
+			delete(f, prime)
+		}
+	}
+	for prime, exp := range num {
+		f[prime] += exp
+	}
+}
+
+// factoredFraction is an instruction p/q precomputed as the prime-exponent
+// maps of p and q.
+type factoredFraction struct {
+	num, den factors
 }
 
 // NewBoundProgram returns a new FRACTRAN Program with a defined step bound.
@@ -211,6 +456,69 @@ func NewProgram(instrs []*big.Rat) (*Program, error) {
 	return NewBoundProgram(instrs, math.Inf(1))
 }
 
+// NewBoundProgramFile is like NewBoundProgram but builds the Program from a
+// *File parsed by Parser.Parse instead of a bare fraction list, so that a
+// non-positive fraction is reported with the source position of its
+// numerator, and Debug output can point back to the instruction's line.
+func NewBoundProgramFile(file *File, b float64) (*Program, error) {
+	if math.IsInf(b, -1) || b <= 0 {
+		return nil, fmt.Errorf("bound must be positive")
+	}
+	for _, frac := range file.Fractions {
+		if frac.Value.Sign() <= 0 {
+			return nil, fmt.Errorf("%v: %v is a non-positive fraction", frac.Pos, frac.Value)
+		}
+	}
+	return &Program{Last: -1, Bound: b, instrs: file.Rats(), file: file}, nil
+}
+
+// NewProgramFile is like NewProgram but builds the Program from a *File
+// parsed by Parser.Parse; see NewBoundProgramFile.
+func NewProgramFile(file *File) (*Program, error) {
+	return NewBoundProgramFile(file, math.Inf(1))
+}
+
+// NewFactoredProgram returns a FRACTRAN Program that represents its running
+// state as a sparse map of prime to exponent instead of a *big.Rat. Each
+// instruction p/q is precomputed as the prime factorizations of p and q, so a
+// step becomes, for each instruction in order, an O(k) check that every
+// prime in its denominator map has at least as large an exponent in the
+// state (k being the number of distinct primes in q), and if so an O(k)
+// subtract-and-add of the denominator and numerator exponents. This avoids
+// the big.Rat multiplication and integer-divisibility test Step otherwise
+// performs on every instruction, which dominates runtime once n grows to the
+// millions of digits programs like Conway's PRIMEGAME reach. The current
+// numeric value of n, when needed for output, is reconstructed lazily as
+// ∏ pᵉ.
+//
+// If any instruction's numerator or denominator has a prime factor larger
+// than MaxFactorPrime (DefaultMaxFactorPrime unless the caller overrides the
+// returned Program's field before calling Run), the returned Program falls
+// back to the big.Rat engine used by NewProgram.
+func NewFactoredProgram(instrs []*big.Rat) (*Program, error) {
+	p, err := NewProgram(instrs)
+	if err != nil {
+		return nil, err
+	}
+	p.MaxFactorPrime = DefaultMaxFactorPrime
+
+	instrFactors := make([]factoredFraction, len(instrs))
+	for i, inst := range instrs {
+		num, ok := factorize(inst.Num(), p.MaxFactorPrime)
+		if !ok {
+			return p, nil
+		}
+		den, ok := factorize(inst.Denom(), p.MaxFactorPrime)
+		if !ok {
+			return p, nil
+		}
+		instrFactors[i] = factoredFraction{num: num, den: den}
+	}
+	p.factored = true
+	p.instrFactors = instrFactors
+	return p, nil
+}
+
 // Step executes one step of the FRACTRAN program as defined by the rules:
 //  1. Find the first fraction f in L where n*f is an integer, assign n*f to n.
 //  2. Repeat step 1 whilst there exists at least one f in L where n*f is an integer.
@@ -222,8 +530,16 @@ func NewProgram(instrs []*big.Rat) (*Program, error) {
 func (p *Program) Step() (*big.Int, error) {
 	if p.Steps == 0 {
 		p.Steps++
-		return p.n.Num(), nil
+		return p.value(), nil
+	}
+	if p.factored {
+		return p.stepFactored()
 	}
+	return p.stepRat()
+}
+
+// stepRat executes one step using the big.Rat engine.
+func (p *Program) stepRat() (*big.Int, error) {
 	for j, i := range p.instrs {
 		tmp := new(big.Rat)
 		tmp.Mul(p.n, i)
@@ -237,47 +553,145 @@ func (p *Program) Step() (*big.Int, error) {
 	return nil, Halt
 }
 
+// stepFactored executes one step using the prime-exponent engine.
+func (p *Program) stepFactored() (*big.Int, error) {
+	for j, f := range p.instrFactors {
+		if p.state.divides(f.den) {
+			p.state.apply(f.num, f.den)
+			p.Last = j
+			p.Steps++
+			return p.value(), nil
+		}
+	}
+	return nil, Halt
+}
+
+// value returns the big.Int currently represented by the program's running
+// state, reconstructing it from the prime-exponent map when running on the
+// factored engine.
+func (p *Program) value() *big.Int {
+	if p.factored {
+		return p.state.value()
+	}
+	return p.n.Num()
+}
+
+// Trace records one step of a FRACTRAN program's execution, as produced by
+// Stream: the step count, the resulting value of n, and the instruction that
+// produced it. Fraction is nil for the zeroth trace, which reports the
+// initial value of n before any instruction has fired. Err is nil for every
+// trace but (optionally) the last: if Step ever returns an error other than
+// Halt, Stream sends one final trace with Err set to it (and N, Last and
+// Fraction left zero) before closing the channel, so a non-Halt error
+// cannot be mistaken for ordinary completion.
+type Trace struct {
+	Step     int64
+	N        *big.Int
+	Last     int
+	Fraction *big.Rat
+	Err      error
+}
+
+// Stream runs the program to completion on its own goroutine, sending a
+// Trace after every step to the returned channel, which is closed once the
+// program halts, its bound is reached, or ctx is done. Callers that only
+// want some of the steps — e.g. filtering Conway's PRIMEGAME down to the
+// steps that emit a prime — can range over the channel and stop early, but
+// only if ctx can still be cancelled at that point: the producer goroutine
+// is parked on a send to the (unbuffered) channel, and the only way to
+// unpark it without a consumer is ctx.Done() firing. Passing
+// context.Background(), or any context whose cancel has already been
+// called, and then abandoning the channel before it closes leaks the
+// producer goroutine forever. Callers that may stop early must derive ctx
+// from context.WithCancel (or WithTimeout/WithDeadline) and either drain
+// the channel to completion or call cancel once they stop ranging over it.
+func (p *Program) Stream(ctx context.Context) <-chan Trace {
+	ch := make(chan Trace)
+	go func() {
+		defer close(ch)
+		for p.Bound > float64(p.Steps) {
+			result, err := p.Step()
+			if err != nil {
+				if Halt != err {
+					select {
+					case ch <- Trace{Err: err}:
+					case <-ctx.Done():
+					}
+				}
+				return
+			}
+			// result aliases the Program's internal state (p.n's numerator, or
+			// a *big.Int freshly built from p.state), which the next iteration
+			// may mutate in place; copy it so a consumer racing the producer
+			// over the channel always sees the value as of this step.
+			trace := Trace{Step: p.Steps, N: new(big.Int).Set(result), Last: p.Last}
+			if p.Last >= 0 && p.Last < len(p.instrs) {
+				trace.Fraction = p.instrs[p.Last]
+			}
+			select {
+			case ch <- trace:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// drain consumes ch, calling emit for every trace that isn't reporting an
+// error, and returns as soon as either a trace carries a non-nil Err or
+// emit itself fails; it returns nil once ch closes without either.
+func drain(ch <-chan Trace, emit func(Trace) error) error {
+	for t := range ch {
+		if nil != t.Err {
+			return t.Err
+		}
+		if err := emit(t); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
 // Run continues to step the FRACTRAN program and writes each result to the output writer.
 // The initial value n must be positive.
 func (p *Program) Run(out io.Writer, n int64) error {
 	if n <= 0 {
 		return fmt.Errorf("n must be positive")
 	}
-	p.n = big.NewRat(n, 1)
-	for p.Bound > float64(p.Steps) {
-		result, err := p.Step()
-		if err == Halt {
-			return nil // Normal termination
-		}
-		if err != nil {
-			return err // Other error
+	if p.factored {
+		state, ok := factorize(big.NewInt(n), p.MaxFactorPrime)
+		if !ok {
+			return fmt.Errorf("%d has a prime factor larger than %d", n, p.MaxFactorPrime)
 		}
-		io.WriteString(out, fmt.Sprintf("%v\n", result))
+		p.state = state
+	} else {
+		p.n = big.NewRat(n, 1)
 	}
-	return nil
+	return drain(p.Stream(context.Background()), func(t Trace) error {
+		io.WriteString(out, fmt.Sprintf("%v\n", t.N))
+		return nil
+	})
 }
 
 // Debug continues to step the FRACTRAN program and writes each result to the output writer.
 // In addition, it lists the instructions and highlights the instruction that produced
 // the new value of n by enclosing it in square brackets.
 func (p *Program) Debug(out io.Writer) error {
-	for p.Bound > float64(p.Steps) {
-		result, err := p.Step()
-		if err == Halt {
-			break
-		}
-		if err != nil {
-			return err
-		}
-		io.WriteString(out, fmt.Sprintf("%v:", result))
+	return drain(p.Stream(context.Background()), func(t Trace) error {
+		io.WriteString(out, fmt.Sprintf("%v:", t.N))
 		for j, i := range p.instrs {
-			if p.Last == j {
-				io.WriteString(out, fmt.Sprintf("\t[%v]", i))
-			} else {
+			if t.Last != j {
 				io.WriteString(out, fmt.Sprintf("\t%v", i)) // Removed trailing space
+				continue
+			}
+			if p.file != nil {
+				io.WriteString(out, fmt.Sprintf("\t[%v]@%v", i, p.file.Fractions[j].Pos))
+			} else {
+				io.WriteString(out, fmt.Sprintf("\t[%v]", i))
 			}
 		}
 		io.WriteString(out, "\n")
-	}
-	return nil
+		return nil
+	})
 }
@@ -5,6 +5,8 @@ package fractran
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"math"
 	"math/big"
 	"os"
@@ -36,12 +38,12 @@ func TestParser(t *testing.T) {
 		for _, tt := range tests {
 			t.Run(tt.name, func(t *testing.T) {
 				parser := new(Parser)
-				instrs, err := parser.Parse(strings.NewReader(tt.input))
+				file, err := parser.Parse(strings.NewReader(tt.input))
 				if err != nil {
 					t.Fatalf("unexpected error: %v", err)
 				}
-				if len(instrs) != tt.expect {
-					t.Errorf("got %d instructions, expected %d", len(instrs), tt.expect)
+				if len(file.Fractions) != tt.expect {
+					t.Errorf("got %d instructions, expected %d", len(file.Fractions), tt.expect)
 				}
 			})
 		}
@@ -49,7 +51,7 @@ func TestParser(t *testing.T) {
 
 	t.Run("PrimeInstructionValues", func(t *testing.T) {
 		parser := new(Parser)
-		instrs, err := parser.Parse(strings.NewReader(primeProgram))
+		file, err := parser.Parse(strings.NewReader(primeProgram))
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -61,17 +63,52 @@ func TestParser(t *testing.T) {
 			big.NewRat(15, 2), big.NewRat(55, 1),
 		}
 
-		for i, instr := range instrs {
+		for i, frac := range file.Fractions {
 			if i >= len(expected) {
 				t.Errorf("got more instructions than expected")
 				break
 			}
-			if instr.Cmp(expected[i]) != 0 {
-				t.Errorf("instruction %d: got %v, expected %v", i, instr, expected[i])
+			if frac.Value.Cmp(expected[i]) != 0 {
+				t.Errorf("instruction %d: got %v, expected %v", i, frac.Value, expected[i])
 			}
 		}
 	})
 
+	t.Run("CommentsAndMultiLine", func(t *testing.T) {
+		input := "# PRIMEGAME, Conway 1987\n3/2, # multiply\n1/3\n"
+		parser := new(Parser)
+		file, err := parser.Parse(strings.NewReader(input))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(file.Fractions) != 2 {
+			t.Fatalf("got %d instructions, expected 2", len(file.Fractions))
+		}
+		if file.Fractions[0].Value.Cmp(big.NewRat(3, 2)) != 0 {
+			t.Errorf("instruction 0: got %v, expected 3/2", file.Fractions[0].Value)
+		}
+		if file.Fractions[0].Pos.Line != 2 {
+			t.Errorf("instruction 0: got line %d, expected 2", file.Fractions[0].Pos.Line)
+		}
+		if file.Fractions[1].Pos.Line != 3 {
+			t.Errorf("instruction 1: got line %d, expected 3", file.Fractions[1].Pos.Line)
+		}
+	})
+
+	t.Run("ParseFractionsBackwardCompat", func(t *testing.T) {
+		parser := new(Parser)
+		instrs, err := parser.ParseFractions(strings.NewReader(simpleProgram))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(instrs) != 2 {
+			t.Fatalf("got %d instructions, expected 2", len(instrs))
+		}
+		if instrs[0].Cmp(big.NewRat(3, 2)) != 0 {
+			t.Errorf("instruction 0: got %v, expected 3/2", instrs[0])
+		}
+	})
+
 	t.Run("InvalidPrograms", func(t *testing.T) {
 		tests := []struct {
 			name  string
@@ -307,6 +344,169 @@ func TestHaltCondition(t *testing.T) {
 	}
 }
 
+func TestFactoredProgram(t *testing.T) {
+	parser := new(Parser)
+	instrs, err := parser.ParseFractions(strings.NewReader(primeProgram))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	t.Run("MatchesBigRatEngine", func(t *testing.T) {
+		ratProg, err := NewBoundProgram(instrs, 100)
+		if err != nil {
+			t.Fatalf("failed to create rat program: %v", err)
+		}
+		var ratBuf bytes.Buffer
+		if err := ratProg.Run(&ratBuf, 2); err != nil {
+			t.Fatalf("rat run failed: %v", err)
+		}
+
+		factoredProg, err := NewFactoredProgram(instrs)
+		if err != nil {
+			t.Fatalf("failed to create factored program: %v", err)
+		}
+		factoredProg.Bound = 100
+		var factoredBuf bytes.Buffer
+		if err := factoredProg.Run(&factoredBuf, 2); err != nil {
+			t.Fatalf("factored run failed: %v", err)
+		}
+
+		if ratBuf.String() != factoredBuf.String() {
+			t.Errorf("factored engine diverged from big.Rat engine:\nrat:      %s\nfactored: %s", ratBuf.String(), factoredBuf.String())
+		}
+	})
+
+	t.Run("FallsBackOnLargePrimeFactor", func(t *testing.T) {
+		prog, err := NewFactoredProgram([]*big.Rat{big.NewRat(1000000007, 1)})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if prog.factored {
+			t.Error("expected fallback to the big.Rat engine for a large prime factor")
+		}
+
+		var buf bytes.Buffer
+		prog.Bound = 2
+		if err := prog.Run(&buf, 1); err != nil {
+			t.Fatalf("run failed: %v", err)
+		}
+		if strings.TrimSpace(buf.String()) != "1\n1000000007" {
+			t.Errorf("got %q, expected fallback output", buf.String())
+		}
+	})
+}
+
+func TestStream(t *testing.T) {
+	t.Run("MatchesRun", func(t *testing.T) {
+		instrs := []*big.Rat{big.NewRat(1, 2)}
+		prog, err := NewBoundProgram(instrs, 5)
+		if err != nil {
+			t.Fatalf("failed to create program: %v", err)
+		}
+		prog.n = big.NewRat(8, 1)
+
+		var traces []Trace
+		for trace := range prog.Stream(context.Background()) {
+			traces = append(traces, trace)
+		}
+
+		want := []string{"8", "4", "2", "1"}
+		if len(traces) != len(want) {
+			t.Fatalf("got %d traces, expected %d", len(traces), len(want))
+		}
+		for i, trace := range traces {
+			if trace.N.String() != want[i] {
+				t.Errorf("trace %d: got N=%s, expected %s", i, trace.N, want[i])
+			}
+			if trace.Step != int64(i+1) {
+				t.Errorf("trace %d: got Step=%d, expected %d", i, trace.Step, i+1)
+			}
+		}
+		if traces[0].Fraction != nil {
+			t.Errorf("trace 0: got Fraction=%v, expected nil for the initial value", traces[0].Fraction)
+		}
+		for _, trace := range traces[1:] {
+			if trace.Fraction == nil || trace.Fraction.Cmp(big.NewRat(1, 2)) != 0 {
+				t.Errorf("trace %d: got Fraction=%v, expected 1/2", trace.Step, trace.Fraction)
+			}
+		}
+	})
+
+	t.Run("CancelStopsProducer", func(t *testing.T) {
+		parser := new(Parser)
+		instrs, err := parser.ParseFractions(strings.NewReader(primeProgram))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		prog, err := NewBoundProgram(instrs, math.Inf(1))
+		if err != nil {
+			t.Fatalf("failed to create program: %v", err)
+		}
+		prog.n = big.NewRat(2, 1)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		stream := prog.Stream(ctx)
+
+		if _, ok := <-stream; !ok {
+			t.Fatal("expected at least one trace before cancelling")
+		}
+		cancel()
+
+		// The producer must see ctx.Done() and close the channel rather than
+		// running forever, even though PRIMEGAME never halts on its own.
+		for range stream {
+		}
+	})
+}
+
+// TestDrain exercises drain's error-forwarding contract directly: Step can
+// currently only ever return Halt, so there is no live path that makes
+// Stream send a Trace with Err set, but Run and Debug must still stop and
+// surface it rather than swallowing it as if the program had halted
+// normally, for whenever a future Step implementation (or the factored
+// engine) does return a real error.
+func TestDrain(t *testing.T) {
+	t.Run("stops on a trace error", func(t *testing.T) {
+		boom := errors.New("boom")
+		ch := make(chan Trace, 2)
+		ch <- Trace{Step: 1, N: big.NewInt(2)}
+		ch <- Trace{Err: boom}
+		close(ch)
+
+		var seen []int64
+		err := drain(ch, func(t Trace) error {
+			seen = append(seen, t.Step)
+			return nil
+		})
+		if boom != err {
+			t.Errorf("got %v, expected %v", err, boom)
+		}
+		if len(seen) != 1 || seen[0] != 1 {
+			t.Errorf("emit ran for %v, expected exactly the trace before the error", seen)
+		}
+	})
+
+	t.Run("stops on an emit error", func(t *testing.T) {
+		boom := errors.New("boom")
+		ch := make(chan Trace, 1)
+		ch <- Trace{Step: 1, N: big.NewInt(2)}
+		close(ch)
+
+		err := drain(ch, func(t Trace) error { return boom })
+		if boom != err {
+			t.Errorf("got %v, expected %v", err, boom)
+		}
+	})
+
+	t.Run("returns nil once the channel closes cleanly", func(t *testing.T) {
+		ch := make(chan Trace)
+		close(ch)
+		if err := drain(ch, func(t Trace) error { return nil }); err != nil {
+			t.Errorf("got %v, expected nil", err)
+		}
+	})
+}
+
 // Benchmark parsing performance
 func BenchmarkParsePrimeProgram(b *testing.B) {
 	for i := 0; i < b.N; i++ {
@@ -337,6 +537,63 @@ func BenchmarkRunSimpleProgram(b *testing.B) {
 	}
 }
 
+// primeProgramBenchBound is how many PRIMEGAME steps BenchmarkPrimeProgram*
+// take. It's high enough that the rat engine's per-step cost (normalizing a
+// big.Rat product via GCD for up to 14 candidate instructions, most of which
+// fail) dominates the factored engine's O(1) map updates, but n itself only
+// reaches on the order of a hundred digits at this step count — nowhere
+// near the "millions of digits" PRIMEGAME eventually produces, which is the
+// regime chunk0-1 actually targeted. Benchmarking at that regime isn't
+// practical here: stepping PRIMEGAME to even a few million steps, let alone
+// far enough to grow n to millions of digits, takes minutes per run, too
+// slow for a benchmark anyone will actually run. Treat the gap below as a
+// lower bound on the real-world win, not the win itself.
+const primeProgramBenchBound = 1000000
+
+// Benchmark the big.Rat engine against the factored (prime-exponent) engine
+// on Conway's PRIMEGAME, where the bottleneck the factored engine targets is
+// most visible.
+func BenchmarkPrimeProgramBigRatEngine(b *testing.B) {
+	parser := new(Parser)
+	instrs, err := parser.ParseFractions(strings.NewReader(primeProgram))
+	if err != nil {
+		b.Fatalf("parse failed: %v", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		prog, err := NewBoundProgram(instrs, primeProgramBenchBound)
+		if err != nil {
+			b.Fatalf("failed to create program: %v", err)
+		}
+		var buf bytes.Buffer
+		if err := prog.Run(&buf, 2); err != nil {
+			b.Fatalf("run failed: %v", err)
+		}
+	}
+}
+
+func BenchmarkPrimeProgramFactoredEngine(b *testing.B) {
+	parser := new(Parser)
+	instrs, err := parser.ParseFractions(strings.NewReader(primeProgram))
+	if err != nil {
+		b.Fatalf("parse failed: %v", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		prog, err := NewFactoredProgram(instrs)
+		if err != nil {
+			b.Fatalf("failed to create program: %v", err)
+		}
+		prog.Bound = primeProgramBenchBound
+		var buf bytes.Buffer
+		if err := prog.Run(&buf, 2); err != nil {
+			b.Fatalf("run failed: %v", err)
+		}
+	}
+}
+
 // Example demonstrating basic FRACTRAN usage
 func ExampleProgram_Run() {
 	// Simple program that halves numbers
@@ -373,13 +630,13 @@ func ExampleProgram_Debug() {
 // Example showing Conway's prime generator
 func ExampleParser_Parse() {
 	parser := new(Parser)
-	instrs, err := parser.Parse(strings.NewReader(primeProgram))
+	file, err := parser.Parse(strings.NewReader(primeProgram))
 	if err != nil {
 		panic(err)
 	}
 
 	// Run Conway's prime-generating program
-	prog, err := NewBoundProgram(instrs, 11)
+	prog, err := NewBoundProgramFile(file, 11)
 	if err != nil {
 		panic(err)
 	}
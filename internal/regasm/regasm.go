@@ -0,0 +1,302 @@
+// Written in 2015 by Jack Galilee. Convenient rights reserved.
+// Use of this source code is governed by the MIT-style
+// license that can be found in the LICENSE file.
+
+// Package regasm implements the register-machine assembly compiler shared
+// by the asm and lang/asm packages: parsing INC/DEC/JZ/JMP/HALT source into
+// an instruction list, and lowering that list into FRACTRAN fractions via
+// Conway's standard construction. It has no dependency on either Program
+// type, so asm and lang/asm each wrap it with a thin API that binds the
+// result to their own engine.
+package regasm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+)
+
+// opKind identifies a register-machine instruction.
+type opKind int
+
+const (
+	opInc opKind = iota
+	opDec
+	opJZ
+	opJMP
+	opHalt
+)
+
+// instr is a single parsed instruction.
+type instr struct {
+	op    opKind
+	reg   string
+	label string
+	line  int
+}
+
+// parse reads a register-machine source file into its instruction list and
+// a map of label to the index of the instruction it names. A line may open
+// with a `label:` prefix, and `#` starts a line comment.
+func parse(src io.Reader) ([]instr, map[string]int, error) {
+	var instrs []instr
+	labels := make(map[string]int)
+
+	scanner := bufio.NewScanner(src)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		if i := strings.IndexByte(text, ':'); i >= 0 {
+			label := strings.TrimSpace(text[:i])
+			if label == "" {
+				return nil, nil, fmt.Errorf("line %d: empty label", line)
+			}
+			if _, exists := labels[label]; exists {
+				return nil, nil, fmt.Errorf("line %d: label %q redefined", line, label)
+			}
+			labels[label] = len(instrs)
+			text = strings.TrimSpace(text[i+1:])
+			if text == "" {
+				continue
+			}
+		}
+		fields := strings.Fields(text)
+		switch op := strings.ToUpper(fields[0]); op {
+		case "INC", "DEC":
+			if len(fields) != 2 {
+				return nil, nil, fmt.Errorf("line %d: %s expects a register", line, op)
+			}
+			kind := opInc
+			if op == "DEC" {
+				kind = opDec
+			}
+			instrs = append(instrs, instr{op: kind, reg: fields[1], line: line})
+		case "JZ":
+			if len(fields) != 3 {
+				return nil, nil, fmt.Errorf("line %d: JZ expects a register and a label", line)
+			}
+			instrs = append(instrs, instr{op: opJZ, reg: fields[1], label: fields[2], line: line})
+		case "JMP":
+			if len(fields) != 2 {
+				return nil, nil, fmt.Errorf("line %d: JMP expects a label", line)
+			}
+			instrs = append(instrs, instr{op: opJMP, label: fields[1], line: line})
+		case "HALT":
+			if len(fields) != 1 {
+				return nil, nil, fmt.Errorf("line %d: HALT takes no operands", line)
+			}
+			instrs = append(instrs, instr{op: opHalt, line: line})
+		default:
+			return nil, nil, fmt.Errorf("line %d: unknown instruction %q", line, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return instrs, labels, nil
+}
+
+// registerNames returns the registers referenced by instrs in first-seen
+// order.
+func registerNames(instrs []instr) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, ins := range instrs {
+		if ins.reg == "" || seen[ins.reg] {
+			continue
+		}
+		seen[ins.reg] = true
+		names = append(names, ins.reg)
+	}
+	return names
+}
+
+// primeGen hands out the sequence of primes 2, 3, 5, 7, 11, ... one at a
+// time, used to assign a distinct prime to each register and
+// program-counter state.
+type primeGen struct {
+	last int64
+}
+
+func (g *primeGen) next() int64 {
+	for candidate := g.last + 1; ; candidate++ {
+		if isPrime(candidate) {
+			g.last = candidate
+			return candidate
+		}
+	}
+}
+
+func isPrime(n int64) bool {
+	if n < 2 {
+		return false
+	}
+	for d := int64(2); d*d <= n; d++ {
+		if n%d == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Assembly is the result of compiling a register-machine source file: the
+// FRACTRAN fraction list, the initial value encoding the program's start
+// state, the prime assigned to each register so a caller can read or seed
+// register values, and the register operation each fraction implements, so
+// a caller stepping the resulting fractions can translate execution back
+// into a trace of those operations.
+type Assembly struct {
+	Fractions []*big.Rat
+	InitialN  int64
+	Registers map[string]int64
+
+	// Ops[i] describes the register-machine operation Fractions[i]
+	// implements.
+	Ops []string
+}
+
+// RegisterValue returns the value held by reg once execution reaches n,
+// i.e. the exponent of reg's prime in n's factorization. It returns 0 for a
+// register that was never referenced by the source.
+func (a *Assembly) RegisterValue(n *big.Int, reg string) int64 {
+	prime, ok := a.Registers[reg]
+	if !ok {
+		return 0
+	}
+	p := big.NewInt(prime)
+	rem := new(big.Int).Set(n)
+	q, r, zero := new(big.Int), new(big.Int), big.NewInt(0)
+	var exp int64
+	for {
+		q.QuoRem(rem, p, r)
+		if r.Cmp(zero) != 0 {
+			break
+		}
+		exp++
+		rem.Set(q)
+	}
+	return exp
+}
+
+// lower translates instrs into FRACTRAN fractions using Conway's standard
+// construction: a distinct prime is assigned to each register and to each
+// program-counter state (instrs has one state per instruction, plus an
+// implicit trailing halt state for control falling off the end), and each
+// opcode becomes a fraction that multiplies/divides by those primes.
+//
+//	INC r  at state i, falling to state j: q_j * p_r / q_i
+//	DEC r  at state i, falling to state j: q_j / (q_i * p_r)
+//	JMP l  at state i, to state j:         q_j / q_i
+//	HALT   at state i:                     no fraction; nothing divides q_i
+//
+// JZ is a non-destructive test, so it needs the standard test-and-branch
+// pattern: an extra helper prime t marks that a unit was borrowed from r to
+// prove r > 0, which is immediately paid back, before falling through; the
+// zero-branch fraction only fires once neither of those two can, i.e. once
+// r has no more units to lend. Listing the nonzero-test fraction before the
+// zero-branch fraction guarantees the nonzero case is tried first:
+//
+//	JZ r l at state i, falling to state j, branching to state k on zero:
+//	  q_j * t / (q_i * p_r)
+//	  p_r / t
+//	  q_k / q_i
+func lower(instrs []instr, labels map[string]int) (*Assembly, error) {
+	gen := new(primeGen)
+
+	// states[i] is the prime for the state before executing instrs[i];
+	// states[len(instrs)] is the implicit halt state reached by falling off
+	// the end of the program.
+	states := make([]int64, len(instrs)+1)
+	for i := range states {
+		states[i] = gen.next()
+	}
+	regs := make(map[string]int64)
+	for _, r := range registerNames(instrs) {
+		regs[r] = gen.next()
+	}
+
+	resolve := func(label string, line int) (int, error) {
+		i, ok := labels[label]
+		if !ok {
+			return 0, fmt.Errorf("line %d: undefined label %q", line, label)
+		}
+		return i, nil
+	}
+
+	var frs []*big.Rat
+	var ops []string
+	for i, ins := range instrs {
+		switch ins.op {
+		case opInc:
+			frs = append(frs, big.NewRat(states[i+1]*regs[ins.reg], states[i]))
+			ops = append(ops, fmt.Sprintf("INC %s", ins.reg))
+		case opDec:
+			frs = append(frs, big.NewRat(states[i+1], states[i]*regs[ins.reg]))
+			ops = append(ops, fmt.Sprintf("DEC %s", ins.reg))
+		case opJMP:
+			j, err := resolve(ins.label, ins.line)
+			if err != nil {
+				return nil, err
+			}
+			frs = append(frs, big.NewRat(states[j], states[i]))
+			ops = append(ops, fmt.Sprintf("JMP %s", ins.label))
+		case opJZ:
+			j, err := resolve(ins.label, ins.line)
+			if err != nil {
+				return nil, err
+			}
+			t := gen.next()
+			frs = append(frs,
+				big.NewRat(states[i+1]*t, states[i]*regs[ins.reg]),
+				big.NewRat(regs[ins.reg], t),
+				big.NewRat(states[j], states[i]),
+			)
+			ops = append(ops,
+				fmt.Sprintf("JZ %s %s (nonzero: fall through)", ins.reg, ins.label),
+				fmt.Sprintf("JZ %s %s (repay borrow)", ins.reg, ins.label),
+				fmt.Sprintf("JZ %s %s (zero: branch)", ins.reg, ins.label),
+			)
+		case opHalt:
+			// No outgoing fraction: nothing in the program divides states[i],
+			// so the FRACTRAN program halts as soon as control reaches it.
+		}
+	}
+
+	return &Assembly{Fractions: frs, InitialN: states[0], Registers: regs, Ops: ops}, nil
+}
+
+// CompileProgram lowers src into an Assembly, exposing the register prime
+// assignment alongside the FRACTRAN program so a caller can seed or decode
+// register values. See Compile for the thinner, position-agnostic form.
+func CompileProgram(src io.Reader) (*Assembly, error) {
+	instrs, labels, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+	if len(instrs) == 0 {
+		return nil, fmt.Errorf("empty program")
+	}
+	return lower(instrs, labels)
+}
+
+// Compile lowers src — a tiny register-machine assembly of INC r, DEC r, JZ
+// r label, JMP label and HALT instructions over labeled blocks — into an
+// equivalent FRACTRAN program and its initial value. See CompileProgram for
+// the full prime assignment table.
+func Compile(src io.Reader) ([]*big.Rat, int64, error) {
+	a, err := CompileProgram(src)
+	if err != nil {
+		return nil, 0, err
+	}
+	return a.Fractions, a.InitialN, nil
+}
@@ -0,0 +1,63 @@
+// Written in 2015 by Jack Galilee. Convenient rights reserved.
+// Use of this source code is governed by the MIT-style
+// license that can be found in the LICENSE file.
+
+// Package asm compiles a small register-machine assembly language into
+// FRACTRAN programs runnable by the lang package. It lets callers write
+// FRACTRAN programs as INC/DEC/JZ/JMP/HALT instructions over named
+// registers instead of hand-crafting Gödel-numbered fractions, and a
+// matching Decompile turns a program's execution back into a trace of
+// those same operations. The compiler itself lives in internal/regasm,
+// shared with the root asm package.
+package asm
+
+import (
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/jgalilee/fractran/internal/regasm"
+	"github.com/jgalilee/fractran/lang"
+)
+
+// Assembly is the result of compiling a register-machine source file. See
+// regasm.Assembly for field documentation.
+type Assembly = regasm.Assembly
+
+// CompileProgram lowers src into an Assembly, exposing the register prime
+// assignment alongside the FRACTRAN program so a caller can seed or decode
+// register values. See Compile for the thinner, position-agnostic form.
+func CompileProgram(src io.Reader) (*Assembly, error) {
+	return regasm.CompileProgram(src)
+}
+
+// Compile lowers src — a tiny register-machine assembly of INC r, DEC r, JZ
+// r label, JMP label and HALT instructions over labeled blocks — into an
+// equivalent FRACTRAN program and its initial value, ready to be run with
+// lang.NewProgram(instrs). See CompileProgram for the full prime assignment
+// table, or Decompile to read an execution trace back out.
+func Compile(src io.Reader) ([]*big.Rat, int64, error) {
+	return regasm.Compile(src)
+}
+
+// Decompile runs prog — which must have been built from a.Fractions, e.g.
+// via lang.NewBoundProgram(a.Fractions, bound) — from the given initial n,
+// and returns a trace of the register-machine operations it performs, one
+// line per FRACTRAN step, by translating each step's Program.Last index
+// back through a's per-fraction operation table. The zeroth step, which
+// reports the initial value of n before any instruction has fired, is
+// omitted since it was not produced by an operation.
+func Decompile(a *Assembly, prog *lang.Program, n int64) ([]string, error) {
+	var trace []string
+	prog.OnStep = func(step int64, result *big.Int) error {
+		if prog.Last < 0 || prog.Last >= len(a.Ops) {
+			return nil
+		}
+		trace = append(trace, fmt.Sprintf("%s -> %v", a.Ops[prog.Last], result))
+		return nil
+	}
+	if err := prog.Run(io.Discard, n); nil != err && lang.Halt != err {
+		return trace, err
+	}
+	return trace, nil
+}
@@ -0,0 +1,129 @@
+// Written in 2015 by Jack Galilee. Convenient rights reserved.
+// Use of this source code is governed by the MIT-style
+// license that can be found in the LICENSE file.
+package asm_test
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/jgalilee/fractran/lang"
+	"github.com/jgalilee/fractran/lang/asm"
+)
+
+func TestCompileInvalidPrograms(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{"empty program", ""},
+		{"unknown instruction", "FOO r1"},
+		{"inc missing register", "INC"},
+		{"jz missing label", "JZ r1"},
+		{"jmp undefined label", "JMP nowhere"},
+		{"duplicate label", "a:\nHALT\na:\nHALT"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := asm.CompileProgram(strings.NewReader(tt.src)); err == nil {
+				t.Errorf("expected error for source %q", tt.src)
+			}
+		})
+	}
+}
+
+// ExampleCompile_addition computes 3+4 using the classic register-machine
+// idiom for addition: drain r2 into r1 one unit at a time.
+func ExampleCompile_addition() {
+	const src = `
+INC r1
+INC r1
+INC r1
+INC r2
+INC r2
+INC r2
+INC r2
+loop:
+JZ r2 done
+DEC r2
+INC r1
+JMP loop
+done:
+HALT
+`
+	a, err := asm.CompileProgram(strings.NewReader(src))
+	if err != nil {
+		panic(err)
+	}
+	prog, err := lang.NewBoundProgram(a.Fractions, 1000)
+	if err != nil {
+		panic(err)
+	}
+	var result *big.Int
+	prog.OnStep = func(step int64, n *big.Int) error {
+		result = n
+		return nil
+	}
+	if err := prog.Run(&bytes.Buffer{}, a.InitialN); err != nil && err != lang.Halt {
+		panic(err)
+	}
+	fmt.Println(a.RegisterValue(result, "r1"), a.RegisterValue(result, "r2"))
+	// Output:
+	// 7 0
+}
+
+// TestDecompileAddition checks that Decompile reconstructs a readable trace
+// of the register operations the addition program above performs.
+func TestDecompileAddition(t *testing.T) {
+	const src = `
+INC r1
+INC r2
+INC r2
+loop:
+JZ r2 done
+DEC r2
+INC r1
+JMP loop
+done:
+HALT
+`
+	a, err := asm.CompileProgram(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	prog, err := lang.NewBoundProgram(a.Fractions, 1000)
+	if err != nil {
+		t.Fatalf("new program: %v", err)
+	}
+	trace, err := asm.Decompile(a, prog, a.InitialN)
+	if err != nil {
+		t.Fatalf("decompile: %v", err)
+	}
+	expect := []string{
+		"INC r1",
+		"INC r2",
+		"INC r2",
+		"JZ r2 done (nonzero: fall through)",
+		"JZ r2 done (repay borrow)",
+		"DEC r2",
+		"INC r1",
+		"JMP loop",
+		"JZ r2 done (nonzero: fall through)",
+		"JZ r2 done (repay borrow)",
+		"DEC r2",
+		"INC r1",
+		"JMP loop",
+		"JZ r2 done (zero: branch)",
+	}
+	if len(trace) != len(expect) {
+		t.Fatalf("got %d steps, expected %d:\n%s", len(trace), len(expect), strings.Join(trace, "\n"))
+	}
+	for i, line := range trace {
+		if !strings.HasPrefix(line, expect[i]) {
+			t.Errorf("step %d: got %q, expected prefix %q", i, line, expect[i])
+		}
+	}
+}
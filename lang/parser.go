@@ -1,6 +1,24 @@
 // Written in 2015 by Jack Galilee. Convenient rights reserved.
 // Use of this source code is governed by the MIT-style
 // license that can be found in the LICENSE file.
+
+// Package lang implements Conway's FRACTRAN programming language.
+// FRACTRAN is a Turing-complete esoteric programming language that consists
+// of a single positive integer and a finite list of positive fractions.
+//
+// This package's Parser accepts decimal and scientific-notation fraction
+// literals in addition to plain integer ratios, and offers ParseString and
+// ParseFile convenience wrappers. Its Program supports context-cancellable
+// execution (RunContext), a pluggable CycleDetector for catching a program
+// stuck in a loop, and gob-based checkpointing (MarshalBinary/Clone). The
+// sibling package github.com/jgalilee/fractran instead has a
+// position-tracking AST (File, FractionLit, ParseError), a prime-exponent
+// execution engine for programs whose n grows too large for big.Rat
+// normalization to stay cheap, and a channel-based Stream API; none of
+// those made it here. The two packages model the same language but were
+// extended independently and haven't been reconciled into one; pick
+// whichever package already has the feature you need, or port it across —
+// they're similar enough that it's usually a small diff.
 package lang
 
 import (
@@ -9,7 +27,8 @@ import (
 	"fmt"
 	"io"
 	"math/big"
-	"strconv"
+	"os"
+	"strings"
 	"unicode"
 )
 
@@ -20,6 +39,11 @@ const (
 	comma symbol = iota
 	digit
 	slash
+	dot
+	expMark
+	sign
+	newline
+	space
 	done
 )
 
@@ -31,6 +55,16 @@ func (s symbol) String() string {
 		return "digit"
 	case slash:
 		return "slash"
+	case dot:
+		return "dot"
+	case expMark:
+		return "exponent marker"
+	case sign:
+		return "sign"
+	case newline:
+		return "newline"
+	case space:
+		return "space"
 	case done:
 		return "done"
 	}
@@ -43,10 +77,12 @@ type Parser struct {
 	currentRune rune
 	lastRune    rune
 	r           *bufio.Reader
+	line        int
 }
 
 // Reads the next rune from the input source. If there was an error reading it
-// panics. It assigns the current rune as the last rune before reading.
+// panics. It assigns the current rune as the last rune before reading, and
+// skips over `#` line comments.
 func (p *Parser) next() {
 	var err error
 	p.lastRune = p.currentRune
@@ -58,14 +94,36 @@ func (p *Parser) next() {
 	if err != nil {
 		panic(err)
 	}
+	if '\n' == p.currentRune {
+		p.line++
+	}
 	// tokenize
 	switch {
+	// comment
+	case p.currentRune == '#':
+		p.skipComment()
+		p.next()
+	// newline
+	case p.currentRune == '\n':
+		p.currentSym = newline
+	// space
+	case p.currentRune == ' ' || p.currentRune == '\t' || p.currentRune == '\r':
+		p.currentSym = space
 	// comma
 	case p.currentRune == ',':
 		p.currentSym = comma
 	// slash
 	case p.currentRune == '/':
 		p.currentSym = slash
+	// dot
+	case p.currentRune == '.':
+		p.currentSym = dot
+	// scientific notation exponent marker
+	case p.currentRune == 'e' || p.currentRune == 'E':
+		p.currentSym = expMark
+	// sign, only meaningful in an exponent
+	case p.currentRune == '+' || p.currentRune == '-':
+		p.currentSym = sign
 	// digit
 	case unicode.IsDigit(p.currentRune):
 		p.currentSym = digit
@@ -75,6 +133,24 @@ func (p *Parser) next() {
 	}
 }
 
+// skipComment consumes runes up to, but not including, the newline that ends
+// a `#` line comment (or up to EOF).
+func (p *Parser) skipComment() {
+	for {
+		r, _, err := p.r.ReadRune()
+		if io.EOF == err {
+			return
+		}
+		if err != nil {
+			panic(err)
+		}
+		if '\n' == r {
+			p.r.UnreadRune()
+			return
+		}
+	}
+}
+
 // Returns the current symbol.
 func (p *Parser) current() symbol {
 	return p.currentSym
@@ -84,7 +160,7 @@ func (p *Parser) current() symbol {
 // an error is returned.
 func (p *Parser) expect(sym symbol) error {
 	if sym != p.current() {
-		return fmt.Errorf("unexpected symbol %v, expected %v", p.current(), sym)
+		return p.errorf("unexpected symbol %v, expected %v", p.current(), sym)
 	}
 	return nil
 }
@@ -99,39 +175,94 @@ func (p *Parser) accept(sym symbol) bool {
 	return false
 }
 
-// Read the next integer from the input source.
-func (p *Parser) integer() (int64, error) {
+// errorf builds an error prefixed with the line the parser is currently on.
+func (p *Parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", p.line, fmt.Sprintf(format, args...))
+}
+
+// skipSpace consumes zero or more consecutive space tokens.
+func (p *Parser) skipSpace() {
+	for p.accept(space) {
+	}
+}
+
+// skipTrivia consumes zero or more consecutive space and newline tokens,
+// allowing blank lines between or around fractions.
+func (p *Parser) skipTrivia() {
+	for p.accept(space) || p.accept(newline) {
+	}
+}
+
+// Read the next number literal from the input source: a decimal integer
+// ("17"), a decimal fraction ("1.5"), or scientific notation ("15e-1"), as
+// accepted by big.Rat.SetString.
+func (p *Parser) number() (*big.Rat, error) {
 	var buff bytes.Buffer
 	if err := p.expect(digit); nil != err {
-		return -1, err
+		return nil, err
 	}
 	for p.accept(digit) {
 		buff.WriteRune(p.lastRune)
 	}
-	return strconv.ParseInt(buff.String(), 10, 64)
+	if p.accept(dot) {
+		buff.WriteRune('.')
+		if err := p.expect(digit); nil != err {
+			return nil, err
+		}
+		for p.accept(digit) {
+			buff.WriteRune(p.lastRune)
+		}
+	}
+	if p.accept(expMark) {
+		buff.WriteRune(p.lastRune)
+		if p.accept(sign) {
+			buff.WriteRune(p.lastRune)
+		}
+		if err := p.expect(digit); nil != err {
+			return nil, err
+		}
+		for p.accept(digit) {
+			buff.WriteRune(p.lastRune)
+		}
+	}
+	v, ok := new(big.Rat).SetString(buff.String())
+	if !ok {
+		return nil, p.errorf("%q is not a valid number literal", buff.String())
+	}
+	return v, nil
 }
 
-// Read the next fraction from the input source.
+// Read the next fraction from the input source. A fraction is either a bare
+// number literal or two number literals separated by a slash; either form
+// must evaluate to a positive value.
 func (p *Parser) fraction() (*big.Rat, error) {
-	var (
-		num int64
-		den int64
-		err error
-	)
-	if num, err = p.integer(); nil != err {
+	num, err := p.number()
+	if nil != err {
 		return nil, err
 	}
-	if err = p.expect(slash); nil != err {
-		return nil, err
+	value := num
+	p.skipSpace()
+	if p.accept(slash) {
+		p.skipSpace()
+		den, err := p.number()
+		if nil != err {
+			return nil, err
+		}
+		if 0 == den.Sign() {
+			return nil, p.errorf("division by zero")
+		}
+		value = new(big.Rat).Quo(num, den)
 	}
-	p.next()
-	if den, err = p.integer(); nil != err {
-		return nil, err
+	if value.Sign() <= 0 {
+		return nil, p.errorf("%v is a non-positive fraction", value)
 	}
-	return big.NewRat(num, den), nil
+	return value, nil
 }
 
-// Read the program from the input source
+// Read the program from the input source. Fractions may be separated by
+// commas, newlines, or just whitespace, and blank lines and `#` comments are
+// ignored, matching the way most published FRACTRAN listings (including
+// Conway's PRIMEGAME) lay fractions out.
 func (p *Parser) program() ([]*big.Rat, error) {
 	var (
 		instr  *big.Rat
@@ -139,18 +270,25 @@ func (p *Parser) program() ([]*big.Rat, error) {
 		err    error
 	)
 	p.next()
+	p.skipTrivia()
+	if done == p.current() {
+		return nil, p.errorf("empty program")
+	}
 	for done != p.current() {
 		instr, err = p.fraction()
 		if nil != err {
 			return nil, err
 		}
 		instrs = append(instrs, instr)
-		for p.accept(comma) {
-			instr, err = p.fraction()
-			if nil != err {
+		p.skipSpace()
+		switch {
+		case p.accept(comma):
+			p.skipTrivia()
+			if err := p.expect(digit); nil != err {
 				return nil, err
 			}
-			instrs = append(instrs, instr)
+		case p.accept(newline):
+			p.skipTrivia()
 		}
 	}
 	return instrs, nil
@@ -159,5 +297,21 @@ func (p *Parser) program() ([]*big.Rat, error) {
 // Parses the input source and returns the program
 func (p *Parser) Parse(src io.Reader) ([]*big.Rat, error) {
 	p.r = bufio.NewReader(src)
+	p.line = 1
 	return p.program()
 }
+
+// ParseString parses a FRACTRAN program from a string.
+func (p *Parser) ParseString(src string) ([]*big.Rat, error) {
+	return p.Parse(strings.NewReader(src))
+}
+
+// ParseFile parses a FRACTRAN program from the named file.
+func (p *Parser) ParseFile(name string) ([]*big.Rat, error) {
+	f, err := os.Open(name)
+	if nil != err {
+		return nil, err
+	}
+	defer f.Close()
+	return p.Parse(f)
+}
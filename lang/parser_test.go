@@ -7,6 +7,8 @@ import (
 	"bytes"
 	"math/big"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -51,7 +53,89 @@ func TestParse(t *testing.T) {
 	}
 }
 
-func ExampleRunFromSource() {
+func TestParseExtendedLiterals(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		expect []*big.Rat
+	}{
+		{"decimal", "1.5, 1/3", []*big.Rat{big.NewRat(3, 2), big.NewRat(1, 3)}},
+		{"scientific", "15e-1, 2e2/4", []*big.Rat{big.NewRat(3, 2), big.NewRat(50, 1)}},
+		{"whitespace only", "2/1 3/2 1/3", []*big.Rat{big.NewRat(2, 1), big.NewRat(3, 2), big.NewRat(1, 3)}},
+		{"comments and blank lines", "2/1 # double\n\n3/2\n", []*big.Rat{big.NewRat(2, 1), big.NewRat(3, 2)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parser := new(Parser)
+			given, err := parser.ParseString(tt.src)
+			if nil != err {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(given) != len(tt.expect) {
+				t.Fatalf("%v given, expected %v", given, tt.expect)
+			}
+			for i := range given {
+				if 0 != given[i].Cmp(tt.expect[i]) {
+					t.Errorf("instruction %d: %v given, expected %v", i, given[i], tt.expect[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseRejectsNonPositiveFractions(t *testing.T) {
+	tests := []string{"0/1", "-1/2", "2/-1", "0"}
+	for _, src := range tests {
+		parser := new(Parser)
+		if _, err := parser.ParseString(src); nil == err {
+			t.Errorf("%q: expected an error, got none", src)
+		} else if !strings.HasPrefix(err.Error(), "line 1: ") {
+			t.Errorf("%q: error %q is not prefixed with a line number", src, err)
+		}
+	}
+}
+
+func TestParseRejectsEmptyProgram(t *testing.T) {
+	tests := []string{"", "   ", "\n\n", "# just a comment\n"}
+	for _, src := range tests {
+		parser := new(Parser)
+		if _, err := parser.ParseString(src); nil == err {
+			t.Errorf("%q: expected an error, got none", src)
+		} else if !strings.HasPrefix(err.Error(), "line ") {
+			t.Errorf("%q: error %q is not prefixed with a line number", src, err)
+		}
+	}
+}
+
+func TestParseRejectsTrailingSeparator(t *testing.T) {
+	tests := []string{"1/2,", "1/2 3/4,", "1/2,\n"}
+	for _, src := range tests {
+		parser := new(Parser)
+		if _, err := parser.ParseString(src); nil == err {
+			t.Errorf("%q: expected an error, got none", src)
+		} else if !strings.HasPrefix(err.Error(), "line ") {
+			t.Errorf("%q: error %q is not prefixed with a line number", src, err)
+		}
+	}
+}
+
+func TestParseFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "program.fractran")
+	if err := os.WriteFile(path, []byte(src), 0644); nil != err {
+		t.Fatalf("failed to write fixture: %v", err)
+	}
+	parser := new(Parser)
+	given, err := parser.ParseFile(path)
+	if nil != err {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if 14 != len(given) {
+		t.Errorf("%v given, expected 14 instructions", len(given))
+	}
+}
+
+func ExampleParser_fromSource() {
 	input := bytes.NewBufferString(src)
 	parser := new(Parser)
 	instrs, err1 := parser.Parse(input)
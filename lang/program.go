@@ -3,17 +3,157 @@
 package lang
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/gob"
 	"errors"
 	"fmt"
 	"io"
 	"math"
 	"math/big"
+	"sort"
 )
 
 // Halt is returned when for a given program either the maximum bound is
 // reached, or nf is not a member of N+ for all f in L.
 var Halt error = errors.New("fractran: done.")
 
+// ErrCycle is the sentinel a *CycleError unwraps to; test against it with
+// errors.Is to notice a cycle without caring about its length or where it
+// was first entered.
+var ErrCycle error = errors.New("fractran: cycle detected")
+
+// CycleError reports that a Program's CycleDetector observed the same
+// (Last, n) state twice: the program has entered a cycle and, absent
+// outside intervention, will run forever without making progress.
+type CycleError struct {
+	// Length is the number of steps between the state's first and second
+	// occurrence.
+	Length int64
+	// Step is the step count at which the state was first seen.
+	Step int64
+}
+
+func (e *CycleError) Error() string {
+	return fmt.Sprintf("%v: length %d, first entered at step %d", ErrCycle, e.Length, e.Step)
+}
+
+func (e *CycleError) Unwrap() error {
+	return ErrCycle
+}
+
+// CycleDetector observes the sequence of (Last, n) states RunContext steps
+// through and reports whether execution has returned to a state already
+// seen. A Program with no CycleDetector set never checks for cycles,
+// matching the Bound-only behaviour existing callers rely on.
+type CycleDetector interface {
+	// Observe records the state reached by taking the given step, and
+	// reports the length of the cycle and the step the state was first
+	// seen at if this exact state has been observed before, or
+	// ok == false if it is new.
+	Observe(step int64, last int, n *big.Int) (length, first int64, ok bool)
+}
+
+// FingerprintCycleDetector is a CycleDetector that remembers up to
+// Capacity distinct states (0 means unbounded) as SHA-256 fingerprints of
+// Last and n.Bytes(), evicting the oldest fingerprint once Capacity is
+// reached. Hashing keeps each remembered state to a fixed 32 bytes
+// regardless of how large n grows, and the bounded, FIFO-evicted cache
+// trades perfect recall for a fixed memory footprint: a program like
+// Conway's PRIMEGAME that runs for millions of steps without cycling would
+// otherwise grow the detector's memory without bound. Callers wanting a
+// different memory/accuracy tradeoff can supply their own CycleDetector
+// instead.
+type FingerprintCycleDetector struct {
+	Capacity int
+
+	seen  map[[sha256.Size]byte]int64
+	order [][sha256.Size]byte
+}
+
+// Observe implements CycleDetector.
+func (d *FingerprintCycleDetector) Observe(step int64, last int, n *big.Int) (length, first int64, ok bool) {
+	if nil == d.seen {
+		d.seen = make(map[[sha256.Size]byte]int64)
+	}
+
+	h := sha256.New()
+	h.Write(n.Bytes())
+	var lastBytes [8]byte
+	binary.BigEndian.PutUint64(lastBytes[:], uint64(last))
+	h.Write(lastBytes[:])
+	var fingerprint [sha256.Size]byte
+	copy(fingerprint[:], h.Sum(nil))
+
+	if first, seen := d.seen[fingerprint]; seen {
+		return step - first, first, true
+	}
+	if d.Capacity > 0 && len(d.order) >= d.Capacity {
+		delete(d.seen, d.order[0])
+		d.order = d.order[1:]
+	}
+	d.seen[fingerprint] = step
+	d.order = append(d.order, fingerprint)
+	return 0, 0, false
+}
+
+// factors maps a prime to its exponent in some larger value's factorization.
+type factors map[int64]int64
+
+// factorize returns the prime factorization of x as a map of prime to
+// exponent.
+func factorize(x *big.Int) factors {
+	f := make(factors)
+	rem := new(big.Int).Abs(x)
+	one := big.NewInt(1)
+	d, q, r := big.NewInt(2), new(big.Int), new(big.Int)
+	for new(big.Int).Mul(d, d).Cmp(rem) <= 0 {
+		for {
+			q.QuoRem(rem, d, r)
+			if 0 != r.Sign() {
+				break
+			}
+			f[d.Int64()]++
+			rem.Set(q)
+		}
+		d.Add(d, one)
+	}
+	if 0 != rem.Cmp(one) {
+		f[rem.Int64()]++
+	}
+	return f
+}
+
+// apply adds num's exponents to f and subtracts den's, in place.
+func (f factors) apply(num, den factors) {
+	for prime, exp := range den {
+		f[prime] -= exp
+		if 0 == f[prime] {
+			delete(f, prime)
+		}
+	}
+	for prime, exp := range num {
+		f[prime] += exp
+	}
+}
+
+// factoredFraction is an instruction p/q precomputed as the prime
+// factorizations of p and q, so the register-machine view of a running
+// program can be updated by applying those factorizations rather than
+// refactorizing n on every step.
+type factoredFraction struct {
+	num, den factors
+}
+
+// RegisterValue pairs a prime with its exponent in a program's current
+// factorization, i.e. the value held by the "register" that prime encodes.
+type RegisterValue struct {
+	Prime, Exponent *big.Int
+}
+
 // FRACTRAN program. It is made up of a starting integer n and a ordered list of
 // positive fractions (instructions).
 type Program struct {
@@ -27,6 +167,28 @@ type Program struct {
 	// Current value of n
 	n      *big.Rat
 	instrs []*big.Rat
+
+	// Prime-exponent view of n, maintained incrementally by Step; nil until
+	// the program has taken its first step.
+	state factors
+	// Prime factorizations of each instruction's numerator and denominator,
+	// cached at construction so State and RegisterState never factorize n
+	// itself.
+	instrFactors []factoredFraction
+	// Primes that Debug annotates alongside n, set by WatchRegisters.
+	watch []int64
+
+	// OnStep, when set, is called after every successful step of
+	// RunContext with the step count and the resulting value of n.
+	// Returning a non-nil error aborts the run with that error.
+	OnStep func(step int64, n *big.Int) error
+
+	// CycleDetector, when set, is consulted by RunContext after every
+	// successful step; if it reports the program has returned to a state
+	// already seen, RunContext aborts with a *CycleError instead of
+	// continuing to step until Bound is exhausted. Leaving it nil preserves
+	// the original Bound-only behaviour.
+	CycleDetector CycleDetector
 }
 
 // Returns a new FRACTRAN Program with a defined bound.
@@ -41,7 +203,11 @@ func NewBoundProgram(instrs []*big.Rat, b float64) (*Program, error) {
 			return nil, fmt.Errorf("%v is a non-positive fraction", i)
 		}
 	}
-	return &Program{Last: -1, Bound: b, instrs: instrs}, nil
+	instrFactors := make([]factoredFraction, len(instrs))
+	for i, instr := range instrs {
+		instrFactors[i] = factoredFraction{num: factorize(instr.Num()), den: factorize(instr.Denom())}
+	}
+	return &Program{Last: -1, Bound: b, instrs: instrs, instrFactors: instrFactors}, nil
 }
 
 // Returns a new FRACTRAN program with an infinite maximum bound.
@@ -62,6 +228,7 @@ func NewProgram(instrs []*big.Rat) (*Program, error) {
 func (p *Program) Step() (*big.Int, error) {
 	if 0 == p.Steps {
 		p.Steps++
+		p.state = factorize(p.n.Num())
 		return p.n.Num(), nil
 	}
 	for j, i := range p.instrs {
@@ -71,45 +238,227 @@ func (p *Program) Step() (*big.Int, error) {
 			p.Last = j
 			p.n.Set(tmp)
 			p.Steps++
+			p.state.apply(p.instrFactors[j].num, p.instrFactors[j].den)
 			return p.n.Num(), nil
 		}
 	}
 	return nil, Halt
 }
 
+// StepContext is like Step, but first checks ctx for cancellation, so a
+// program that never halts on its own (Conway's PRIMEGAME being the classic
+// example) can be stopped from outside the Bound mechanism. It returns
+// ctx.Err(), distinct from Halt, once ctx is done.
+func (p *Program) StepContext(ctx context.Context) (*big.Int, error) {
+	if nil != ctx.Err() {
+		return nil, ctx.Err()
+	}
+	return p.Step()
+}
+
+// State returns the register-machine view of the program's current value of
+// n: a copy of the prime-exponent map maintained incrementally by Step. It
+// returns nil if Step has not yet been called.
+func (p *Program) State() map[int64]int64 {
+	if nil == p.state {
+		return nil
+	}
+	state := make(map[int64]int64, len(p.state))
+	for prime, exp := range p.state {
+		state[prime] = exp
+	}
+	return state
+}
+
+// RegisterState decomposes the program's current value of n into its prime
+// factorization, returning one RegisterValue per prime with a nonzero
+// exponent, sorted by ascending prime. It returns an error if Step has not
+// yet been called.
+func (p *Program) RegisterState() ([]RegisterValue, error) {
+	if nil == p.state {
+		return nil, fmt.Errorf("program has not taken its first step")
+	}
+	primes := make([]int64, 0, len(p.state))
+	for prime := range p.state {
+		primes = append(primes, prime)
+	}
+	sort.Slice(primes, func(i, j int) bool { return primes[i] < primes[j] })
+	values := make([]RegisterValue, len(primes))
+	for i, prime := range primes {
+		values[i] = RegisterValue{Prime: big.NewInt(prime), Exponent: big.NewInt(p.state[prime])}
+	}
+	return values, nil
+}
+
+// WatchRegisters restricts Debug's per-step annotation to the exponents of
+// the given primes, e.g. WatchRegisters(2) to follow just the power of 2 in
+// Conway's PRIMEGAME instead of eyeballing n itself.
+func (p *Program) WatchRegisters(primes ...int64) {
+	p.watch = primes
+}
+
 // Continues to step the FRACTRAN program and writes the result to the output
 // writer.
 func (p *Program) Run(out io.Writer, n int64) error {
+	return p.RunContext(context.Background(), out, n)
+}
+
+// RunContext is like Run, but checks ctx between steps and returns
+// ctx.Err() (distinct from Halt) as soon as ctx is cancelled or its
+// deadline passes, letting a caller embedding fractran in a REPL, HTTP
+// handler, or test stop a program that is taking too long without waiting
+// for Bound to expire. If CycleDetector is set, it is consulted after every
+// successful step, and a detected cycle aborts the run with a *CycleError.
+// If OnStep is set, it is called after every successful step, and a
+// non-nil return aborts the run with that error.
+func (p *Program) RunContext(ctx context.Context, out io.Writer, n int64) error {
 	if n <= 0 {
 		return fmt.Errorf("n must be positive")
 	}
 	p.n = big.NewRat(n, 1)
 	for p.Bound > float64(p.Steps) {
-		if n, err := p.Step(); Halt != err {
-			io.WriteString(out, fmt.Sprintf("%v\n", n))
-		} else {
+		result, err := p.StepContext(ctx)
+		if nil != err {
 			return err
 		}
+		if nil != p.CycleDetector {
+			if length, first, ok := p.CycleDetector.Observe(p.Steps, p.Last, result); ok {
+				return &CycleError{Length: length, Step: first}
+			}
+		}
+		if nil != p.OnStep {
+			if err := p.OnStep(p.Steps, result); nil != err {
+				return err
+			}
+		}
+		io.WriteString(out, fmt.Sprintf("%v\n", result))
 	}
 	return nil
 }
 
 // Continues to step the FRACTRAN program and writes the result to the output
 // writer. In addition it list the instructions and highlights the instruction
-// that gave the new value of n by enclosing it in square brackets.
+// that gave the new value of n by enclosing it in square brackets. If
+// WatchRegisters has been called, each line is further annotated with the
+// exponent of every watched prime, e.g. "p2=15" for the power of 2 in n.
 func (p *Program) Debug(out io.Writer) error {
 	for p.Bound > float64(p.Steps) {
-		if n, err := p.Step(); Halt != err {
-			io.WriteString(out, fmt.Sprintf("%v:", n))
-			for j, i := range p.instrs {
-				if p.Last == j {
-					io.WriteString(out, fmt.Sprintf("\t[%v]", i))
-				} else {
-					io.WriteString(out, fmt.Sprintf("\t %v ", i))
-				}
+		n, err := p.Step()
+		if Halt == err {
+			break
+		}
+		io.WriteString(out, fmt.Sprintf("%v:", n))
+		for j, i := range p.instrs {
+			if p.Last == j {
+				io.WriteString(out, fmt.Sprintf("\t[%v]", i))
+			} else {
+				io.WriteString(out, fmt.Sprintf("\t %v ", i))
 			}
 		}
+		for _, prime := range p.watch {
+			io.WriteString(out, fmt.Sprintf("\tp%v=%v", prime, p.state[prime]))
+		}
 		io.WriteString(out, "\n")
 	}
 	return nil
 }
+
+// gobProgram is the gob-encodable checkpoint of a Program's execution
+// state: its instruction list, current n, and everything Step needs to
+// carry on from there. It leaves out watch and OnStep, which are
+// per-invocation plumbing rather than part of the computation being
+// checkpointed.
+type gobProgram struct {
+	Instrs []*big.Rat
+	Bound  float64
+	Steps  int64
+	Last   int
+	N      *big.Rat
+	State  factors
+}
+
+// MarshalBinary encodes the program's instructions and its current
+// execution state (Bound, Steps, Last, n and the register-machine view
+// maintained by Step) so a computation that takes millions of steps to
+// reach an interesting n, such as Conway's PRIMEGAME, can be checkpointed
+// and resumed without starting over from n's initial value.
+func (p *Program) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	g := gobProgram{Instrs: p.instrs, Bound: p.Bound, Steps: p.Steps, Last: p.Last, N: p.n, State: p.state}
+	if err := gob.NewEncoder(&buf).Encode(g); nil != err {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a checkpoint written by MarshalBinary into the
+// receiver, replacing its instruction list and execution state.
+func (p *Program) UnmarshalBinary(data []byte) error {
+	var g gobProgram
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&g); nil != err {
+		return err
+	}
+	instrFactors := make([]factoredFraction, len(g.Instrs))
+	for i, instr := range g.Instrs {
+		instrFactors[i] = factoredFraction{num: factorize(instr.Num()), den: factorize(instr.Denom())}
+	}
+	p.instrs = g.Instrs
+	p.instrFactors = instrFactors
+	p.Bound = g.Bound
+	p.Steps = g.Steps
+	p.Last = g.Last
+	p.n = g.N
+	p.state = g.State
+	return nil
+}
+
+// MarshalText renders a checkpoint as base64 of MarshalBinary's output, so
+// it can round-trip through text-only channels such as JSON fields, config
+// files or log lines.
+func (p *Program) MarshalText() ([]byte, error) {
+	data, err := p.MarshalBinary()
+	if nil != err {
+		return nil, err
+	}
+	text := make([]byte, base64.StdEncoding.EncodedLen(len(data)))
+	base64.StdEncoding.Encode(text, data)
+	return text, nil
+}
+
+// UnmarshalText decodes a checkpoint written by MarshalText into the
+// receiver.
+func (p *Program) UnmarshalText(text []byte) error {
+	data := make([]byte, base64.StdEncoding.DecodedLen(len(text)))
+	n, err := base64.StdEncoding.Decode(data, text)
+	if nil != err {
+		return err
+	}
+	return p.UnmarshalBinary(data[:n])
+}
+
+// Clone returns an independent copy of p that can be stepped or run without
+// affecting p, so a checkpointed program can be forked to explore several
+// continuations from the same state. The instruction list is immutable
+// once a Program is constructed, so it and its cached factorizations are
+// shared rather than copied; OnStep is not carried over, since it is tied
+// to a particular caller's invocation rather than the computation itself.
+func (p *Program) Clone() *Program {
+	clone := &Program{
+		Last:         p.Last,
+		Steps:        p.Steps,
+		Bound:        p.Bound,
+		instrs:       p.instrs,
+		instrFactors: p.instrFactors,
+		watch:        append([]int64(nil), p.watch...),
+	}
+	if nil != p.n {
+		clone.n = new(big.Rat).Set(p.n)
+	}
+	if nil != p.state {
+		clone.state = make(factors, len(p.state))
+		for prime, exp := range p.state {
+			clone.state[prime] = exp
+		}
+	}
+	return clone
+}
@@ -4,11 +4,16 @@
 package lang
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"math"
 	"math/big"
 	"os"
+	"testing"
 )
 
-func ExampleRun() {
+func ExampleProgram_run() {
 	inst := []*big.Rat{
 		big.NewRat(17, 91),
 		big.NewRat(78, 85),
@@ -43,3 +48,233 @@ func ExampleRun() {
 	// 290
 	// 770
 }
+
+func TestRegisterState(t *testing.T) {
+	inst := []*big.Rat{
+		big.NewRat(17, 91),
+		big.NewRat(78, 85),
+		big.NewRat(19, 51),
+		big.NewRat(23, 38),
+		big.NewRat(29, 33),
+		big.NewRat(77, 29),
+		big.NewRat(95, 23),
+		big.NewRat(77, 19),
+		big.NewRat(1, 17),
+		big.NewRat(11, 13),
+		big.NewRat(13, 11),
+		big.NewRat(15, 14),
+		big.NewRat(15, 2),
+		big.NewRat(55, 1),
+	}
+	prg, err := NewBoundProgram(inst, 11)
+	if nil != err {
+		panic(err)
+	}
+	if nil != prg.State() {
+		t.Errorf("State() = %v before any step, expected nil", prg.State())
+	}
+	prg.WatchRegisters(2)
+	prg.Run(&bytes.Buffer{}, 2) // runs to n = 770 = 2 * 5 * 7 * 11
+	values, err := prg.RegisterState()
+	if nil != err {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expect := []RegisterValue{
+		{Prime: big.NewInt(2), Exponent: big.NewInt(1)},
+		{Prime: big.NewInt(5), Exponent: big.NewInt(1)},
+		{Prime: big.NewInt(7), Exponent: big.NewInt(1)},
+		{Prime: big.NewInt(11), Exponent: big.NewInt(1)},
+	}
+	if len(values) != len(expect) {
+		t.Fatalf("got %v, expected %v", values, expect)
+	}
+	for i, v := range values {
+		if 0 != v.Prime.Cmp(expect[i].Prime) || 0 != v.Exponent.Cmp(expect[i].Exponent) {
+			t.Errorf("register %d: got %v/%v, expected %v/%v", i, v.Prime, v.Exponent, expect[i].Prime, expect[i].Exponent)
+		}
+	}
+	if exp := prg.State()[2]; 1 != exp {
+		t.Errorf("State()[2] = %v, expected 1", exp)
+	}
+}
+
+// ExampleProgram_Debug shows Debug's per-step trace, with WatchRegisters
+// annotating the exponent of the power of 2 in n alongside each step, and
+// confirms Debug returns once the program halts instead of looping forever.
+func ExampleProgram_Debug() {
+	instrs := []*big.Rat{big.NewRat(1, 2)}
+	prg, err := NewProgram(instrs)
+	if nil != err {
+		panic(err)
+	}
+	prg.n = big.NewRat(8, 1)
+	prg.WatchRegisters(2)
+	prg.Debug(os.Stdout)
+	// Output:
+	// 8:	 1/2 	p2=3
+	// 4:	[1/2]	p2=2
+	// 2:	[1/2]	p2=1
+	// 1:	[1/2]	p2=0
+}
+
+func TestRunContextCancel(t *testing.T) {
+	// The prime program never halts on its own, so cancelling ctx is the
+	// only way to stop it.
+	inst := []*big.Rat{
+		big.NewRat(17, 91),
+		big.NewRat(78, 85),
+		big.NewRat(19, 51),
+		big.NewRat(23, 38),
+		big.NewRat(29, 33),
+		big.NewRat(77, 29),
+		big.NewRat(95, 23),
+		big.NewRat(77, 19),
+		big.NewRat(1, 17),
+		big.NewRat(11, 13),
+		big.NewRat(13, 11),
+		big.NewRat(15, 14),
+		big.NewRat(15, 2),
+		big.NewRat(55, 1),
+	}
+	prg, err := NewProgram(inst)
+	if nil != err {
+		panic(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	steps := 0
+	prg.OnStep = func(step int64, n *big.Int) error {
+		steps++
+		if 3 == steps {
+			cancel()
+		}
+		return nil
+	}
+	err = prg.RunContext(ctx, &bytes.Buffer{}, 2)
+	if context.Canceled != err {
+		t.Errorf("got %v, expected context.Canceled", err)
+	}
+	if 3 != steps {
+		t.Errorf("OnStep ran %d times, expected exactly 3 before cancellation was observed", steps)
+	}
+}
+
+func TestRunContextOnStepAbort(t *testing.T) {
+	inst := []*big.Rat{big.NewRat(1, 2)}
+	prg, err := NewProgram(inst)
+	if nil != err {
+		panic(err)
+	}
+	abort := errors.New("stop")
+	prg.OnStep = func(step int64, n *big.Int) error {
+		return abort
+	}
+	if err := prg.RunContext(context.Background(), &bytes.Buffer{}, 8); abort != err {
+		t.Errorf("got %v, expected %v", err, abort)
+	}
+}
+
+func TestRunContextCycleDetected(t *testing.T) {
+	// 2 -> 3 -> 2 -> 3 ... forever: 3/2 fires on 2, 2/3 fires on 3.
+	inst := []*big.Rat{big.NewRat(3, 2), big.NewRat(2, 3)}
+	prg, err := NewProgram(inst)
+	if nil != err {
+		panic(err)
+	}
+	prg.CycleDetector = &FingerprintCycleDetector{}
+	err = prg.RunContext(context.Background(), &bytes.Buffer{}, 2)
+	var cycleErr *CycleError
+	if !errors.As(err, &cycleErr) {
+		t.Fatalf("got %v, expected a *CycleError", err)
+	}
+	if !errors.Is(err, ErrCycle) {
+		t.Errorf("errors.Is(err, ErrCycle) = false, expected true")
+	}
+	// Observed (step, Last, n) triples are (1,-1,2), (2,0,3), (3,1,2),
+	// (4,0,3): the fourth repeats the second's (Last, n), a cycle of
+	// length 2 first entered at step 2.
+	if 2 != cycleErr.Length {
+		t.Errorf("Length = %v, expected 2", cycleErr.Length)
+	}
+	if 2 != cycleErr.Step {
+		t.Errorf("Step = %v, expected 2", cycleErr.Step)
+	}
+}
+
+func TestRunContextNoCycleDetectorByDefault(t *testing.T) {
+	// Same cyclic program as above, but with no CycleDetector set: RunContext
+	// must fall back to its original Bound-only behaviour and run forever
+	// until Bound is exhausted.
+	inst := []*big.Rat{big.NewRat(3, 2), big.NewRat(2, 3)}
+	prg, err := NewBoundProgram(inst, 5)
+	if nil != err {
+		panic(err)
+	}
+	if err := prg.RunContext(context.Background(), &bytes.Buffer{}, 2); nil != err {
+		t.Errorf("got %v, expected nil (Bound reached without error)", err)
+	}
+	if 5 != prg.Steps {
+		t.Errorf("Steps = %v, expected 5", prg.Steps)
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	// Run only stepped as far as n = 4 (Bound stops it one step short of
+	// halting); resuming continues from there via Step, not Run, since Run
+	// always reseeds n from its argument.
+	inst := []*big.Rat{big.NewRat(1, 2)}
+	prg, err := NewBoundProgram(inst, 3)
+	if nil != err {
+		panic(err)
+	}
+	prg.Run(&bytes.Buffer{}, 8)
+
+	data, err := prg.MarshalBinary()
+	if nil != err {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+	resumed := new(Program)
+	if err := resumed.UnmarshalBinary(data); nil != err {
+		t.Fatalf("UnmarshalBinary: %v", err)
+	}
+	if resumed.Steps != prg.Steps || resumed.Last != prg.Last || 0 != resumed.n.Cmp(prg.n) {
+		t.Fatalf("UnmarshalBinary did not restore the checkpointed state")
+	}
+	resumed.Bound = math.Inf(1)
+	if result, err := resumed.Step(); nil != err || 0 != result.Cmp(big.NewInt(1)) {
+		t.Errorf("resumed step: got %v, %v, expected 1, <nil>", result, err)
+	}
+
+	text, err := prg.MarshalText()
+	if nil != err {
+		t.Fatalf("MarshalText: %v", err)
+	}
+	fromText := new(Program)
+	if err := fromText.UnmarshalText(text); nil != err {
+		t.Fatalf("UnmarshalText: %v", err)
+	}
+	if fromText.Steps != prg.Steps || fromText.Last != prg.Last || 0 != fromText.n.Cmp(prg.n) {
+		t.Errorf("UnmarshalText did not restore the checkpointed state")
+	}
+}
+
+func TestClone(t *testing.T) {
+	inst := []*big.Rat{big.NewRat(1, 2)}
+	prg, err := NewProgram(inst)
+	if nil != err {
+		panic(err)
+	}
+	prg.Run(&bytes.Buffer{}, 8)
+
+	clone := prg.Clone()
+	if _, err := clone.Step(); Halt != err {
+		t.Fatalf("expected clone to have halted alongside the original, got %v", err)
+	}
+	if 0 != prg.n.Cmp(big.NewRat(1, 1)) {
+		t.Errorf("original program's n = %v, expected 1 (halted)", prg.n)
+	}
+	clone.n.Set(big.NewRat(2, 1))
+	if 0 == prg.n.Cmp(clone.n) {
+		t.Errorf("mutating the clone's n should not affect the original")
+	}
+}